@@ -0,0 +1,76 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"github.com/pkg/errors"
+
+	"oneinfra.ereslibre.es/m/internal/pkg/infra"
+	"oneinfra.ereslibre.es/m/internal/pkg/node"
+)
+
+// ClusterReconcilerInquirer implements nodereconciler.Inquirer backed by a
+// ClusterReconciler's already-gathered state, so nodereconciler.Reconcile
+// doesn't need to know how that state was obtained
+type ClusterReconcilerInquirer struct {
+	node              *node.Node
+	clusterReconciler *ClusterReconciler
+}
+
+// Node implements nodereconciler.Inquirer
+func (inquirer *ClusterReconcilerInquirer) Node() *node.Node {
+	return inquirer.node
+}
+
+// Hypervisor implements nodereconciler.Inquirer
+func (inquirer *ClusterReconcilerInquirer) Hypervisor() (*infra.Hypervisor, error) {
+	hypervisor, exists := inquirer.clusterReconciler.hypervisorMap[inquirer.node.HypervisorName]
+	if !exists {
+		return nil, errors.Errorf("hypervisor %q not found for node %q", inquirer.node.HypervisorName, inquirer.node.Name)
+	}
+	return hypervisor, nil
+}
+
+// ClusterCertificateAuthority implements nodereconciler.Inquirer
+func (inquirer *ClusterReconcilerInquirer) ClusterCertificateAuthority() ([]byte, []byte, error) {
+	ca := inquirer.clusterReconciler.clusterObj.Status.CertificateAuthority
+	if len(ca.Certificate) == 0 || len(ca.PrivateKey) == 0 {
+		return nil, nil, errors.Errorf("cluster %q has no certificate authority yet", inquirer.clusterReconciler.clusterObj.Name)
+	}
+	return ca.Certificate, ca.PrivateKey, nil
+}
+
+// APIServerEndpoint implements nodereconciler.Inquirer, returning the
+// hypervisor address and reserved apiserver port of the first control
+// plane (or control plane ingress) node found for this cluster
+func (inquirer *ClusterReconcilerInquirer) APIServerEndpoint() (string, int, error) {
+	for _, nodeObj := range inquirer.clusterReconciler.nodeList {
+		if nodeObj.Role != node.ControlPlaneRole && nodeObj.Role != node.ControlPlaneIngressRole {
+			continue
+		}
+		hypervisor, exists := inquirer.clusterReconciler.hypervisorMap[nodeObj.HypervisorName]
+		if !exists {
+			continue
+		}
+		port, hasPort := nodeObj.PortByPurpose("apiserver")
+		if !hasPort || hypervisor.Address == "" {
+			continue
+		}
+		return hypervisor.Address, port, nil
+	}
+	return "", 0, errors.Errorf("cluster %q has no control plane node with an apiserver port reserved yet", inquirer.clusterReconciler.clusterObj.Name)
+}
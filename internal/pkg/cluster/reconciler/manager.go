@@ -0,0 +1,93 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	clusterv1alpha1 "oneinfra.ereslibre.es/m/apis/cluster/v1alpha1"
+)
+
+const (
+	// DefaultLeaderElectionID is the default lease name used for leader election
+	DefaultLeaderElectionID = "oneinfra-controller-leader-election"
+	// defaultBaseBackoff is the initial requeue backoff after a failed reconciliation
+	defaultBaseBackoff = 5 * time.Millisecond
+	// defaultMaxBackoff is the maximum requeue backoff after repeated failed reconciliations
+	defaultMaxBackoff = 1000 * time.Second
+)
+
+// ManagerOptions configures the controller-runtime based reconciliation manager
+type ManagerOptions struct {
+	// LeaderElection enables lease-based leader election so that only one
+	// of several running oneinfra controller replicas reconciles at a time
+	LeaderElection bool
+	// LeaderElectionID is the name of the lease used for leader election;
+	// defaults to DefaultLeaderElectionID when empty
+	LeaderElectionID string
+	// LeaderElectionNamespace is the namespace the leader election lease lives in
+	LeaderElectionNamespace string
+	// MetricsBindAddress is the address the controller-runtime metrics endpoint binds to
+	MetricsBindAddress string
+}
+
+// NewManager creates a controller-runtime manager wired with the Cluster
+// reconciler, ready to be Start()ed as a long-running, event-driven
+// reconciliation loop that reacts to Cluster, Node and Hypervisor changes
+// instead of requiring an external driver to invoke Reconcile. Node and
+// Hypervisor changes are folded into Cluster reconciliation by
+// ClusterReconciler's own Watches, rather than by dedicated
+// reconcilers for those kinds.
+func NewManager(cfg *rest.Config, options ManagerOptions) (manager.Manager, error) {
+	scheme := runtime.NewScheme()
+	if err := clusterv1alpha1.AddToScheme(scheme); err != nil {
+		return nil, errors.Wrap(err, "could not register clusterv1alpha1 types")
+	}
+	leaderElectionID := options.LeaderElectionID
+	if leaderElectionID == "" {
+		leaderElectionID = DefaultLeaderElectionID
+	}
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:                  scheme,
+		LeaderElection:          options.LeaderElection,
+		LeaderElectionID:        leaderElectionID,
+		LeaderElectionNamespace: options.LeaderElectionNamespace,
+		MetricsBindAddress:      options.MetricsBindAddress,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create controller-runtime manager")
+	}
+	if err := (&ClusterReconciler{}).SetupWithManager(mgr); err != nil {
+		return nil, errors.Wrap(err, "could not set up cluster reconciler")
+	}
+	return mgr, nil
+}
+
+// defaultRateLimiter returns the exponential backoff rate limiter used by
+// the Cluster reconciler's workqueue, so that a Cluster whose
+// reconciliation keeps failing is retried with increasing delay instead of
+// hot-looping
+func defaultRateLimiter() workqueue.RateLimiter {
+	return workqueue.NewItemExponentialFailureRateLimiter(defaultBaseBackoff, defaultMaxBackoff)
+}
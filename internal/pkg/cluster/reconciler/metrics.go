@@ -0,0 +1,88 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// metricsFactory registers every metric below on the controller-runtime
+// Manager's own registry instead of the Prometheus default one, so they
+// appear on the manager's /metrics endpoint (configured through
+// ManagerOptions.MetricsBindAddress) rather than nowhere
+var metricsFactory = promauto.With(ctrlmetrics.Registry)
+
+var (
+	reconcilesTotal = metricsFactory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "oneinfra",
+			Subsystem: "reconciler",
+			Name:      "reconciles_total",
+			Help:      "Total number of cluster reconciliations attempted, by result",
+		},
+		[]string{"result"},
+	)
+	reconcileErrorsTotal = metricsFactory.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "oneinfra",
+			Subsystem: "reconciler",
+			Name:      "reconcile_errors_total",
+			Help:      "Total number of cluster reconciliations that returned an error",
+		},
+		[]string{"cluster"},
+	)
+	reconcileDuration = metricsFactory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "oneinfra",
+			Subsystem: "reconciler",
+			Name:      "node_reconcile_duration_seconds",
+			Help:      "Duration of a single node reconciliation, by node role",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"role"},
+	)
+	portAllocationLatency = metricsFactory.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "oneinfra",
+			Subsystem: "reconciler",
+			Name:      "hypervisor_port_allocation_latency_seconds",
+			Help:      "Latency of allocating a host port on a hypervisor",
+			Buckets:   prometheus.DefBuckets,
+		},
+	)
+	nodesPerCluster = metricsFactory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "oneinfra",
+			Subsystem: "reconciler",
+			Name:      "nodes_per_cluster",
+			Help:      "Number of nodes known to a cluster",
+		},
+		[]string{"cluster"},
+	)
+	allocatedHostPorts = metricsFactory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "oneinfra",
+			Subsystem: "reconciler",
+			Name:      "hypervisor_allocated_host_ports",
+			Help:      "Number of host ports currently allocated on a hypervisor",
+		},
+		[]string{"hypervisor"},
+	)
+)
@@ -17,45 +17,342 @@ limitations under the License.
 package reconciler
 
 import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 
+	clusterv1alpha1 "oneinfra.ereslibre.es/m/apis/cluster/v1alpha1"
 	"oneinfra.ereslibre.es/m/internal/pkg/cluster"
 	"oneinfra.ereslibre.es/m/internal/pkg/infra"
 	"oneinfra.ereslibre.es/m/internal/pkg/node"
 	nodereconciler "oneinfra.ereslibre.es/m/internal/pkg/node/reconciler"
 )
 
-// ClusterReconciler represents a cluster reconciler
+// tracer is the OpenTelemetry tracer used for node reconciliation spans
+var tracer = otel.Tracer("oneinfra.ereslibre.es/m/internal/pkg/cluster/reconciler")
+
+// ClusterReconciler reconciles a Cluster object. Unlike the previous one-shot
+// implementation, it is registered against a controller-runtime Manager and
+// is invoked by the workqueue whenever a Cluster, or one of the Nodes that
+// belong to it, changes, instead of requiring an external driver to call
+// Reconcile.
 type ClusterReconciler struct {
+	client.Client
+
+	clusterObj    clusterv1alpha1.Cluster
 	hypervisorMap infra.HypervisorMap
 	clusterMap    cluster.Map
 	nodeList      node.List
 }
 
-// NewClusterReconciler creates a cluster reconciler with the provided hypervisors, clusters and nodes
-func NewClusterReconciler(hypervisorMap infra.HypervisorMap, clusterMap cluster.Map, nodeList node.List) *ClusterReconciler {
-	return &ClusterReconciler{
-		hypervisorMap: hypervisorMap,
-		clusterMap:    clusterMap,
-		nodeList:      nodeList,
+// nodeClusterField is the name under which Nodes are indexed by their
+// spec.cluster, so that gather can list a single cluster's nodes without a
+// full list-and-filter scan
+const nodeClusterField = "spec.cluster"
+
+// SetupWithManager wires this reconciler into the provided manager, watching
+// Clusters and the Nodes that belong to them
+func (clusterReconciler *ClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	clusterReconciler.Client = mgr.GetClient()
+	if err := mgr.GetFieldIndexer().IndexField(
+		context.Background(),
+		&clusterv1alpha1.Node{},
+		nodeClusterField,
+		func(obj client.Object) []string {
+			nodeObj, ok := obj.(*clusterv1alpha1.Node)
+			if !ok {
+				return nil
+			}
+			return []string{nodeObj.Spec.Cluster}
+		},
+	); err != nil {
+		return errors.Wrap(err, "could not index nodes by spec.cluster")
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&clusterv1alpha1.Cluster{}).
+		Watches(
+			&clusterv1alpha1.Node{},
+			handler.EnqueueRequestsFromMapFunc(clusterForNode),
+		).
+		Watches(
+			&clusterv1alpha1.Hypervisor{},
+			handler.EnqueueRequestsFromMapFunc(clusterReconciler.clustersForHypervisor(mgr.GetClient())),
+		).
+		WithOptions(controller.Options{RateLimiter: defaultRateLimiter()}).
+		Complete(clusterReconciler)
+}
+
+// clusterForNode maps a Node change event straight to the Cluster it
+// belongs to via spec.cluster. Nodes are never given a controller owner
+// reference back to their Cluster (they are authored independently of it),
+// so Owns(&clusterv1alpha1.Node{}) would never enqueue anything; this watch
+// reads the owning cluster directly off the event's Node instead.
+func clusterForNode(ctx context.Context, obj client.Object) []ctrl.Request {
+	nodeObj, ok := obj.(*clusterv1alpha1.Node)
+	if !ok || nodeObj.Spec.Cluster == "" {
+		return nil
+	}
+	return []ctrl.Request{{NamespacedName: client.ObjectKey{Name: nodeObj.Spec.Cluster}}}
+}
+
+// clustersForHypervisor returns a mapping function that, given a Hypervisor
+// change event, enqueues every Cluster that currently has a Node scheduled
+// on it, so hypervisor availability changes trigger reconciliation of the
+// clusters they affect instead of being dropped on the floor
+func (clusterReconciler *ClusterReconciler) clustersForHypervisor(c client.Client) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []ctrl.Request {
+		hypervisor, ok := obj.(*clusterv1alpha1.Hypervisor)
+		if !ok {
+			return nil
+		}
+		var nodeList clusterv1alpha1.NodeList
+		if err := c.List(ctx, &nodeList); err != nil {
+			klog.Errorf("could not list nodes while mapping hypervisor %q to clusters: %v", hypervisor.Name, err)
+			return nil
+		}
+		seen := map[string]struct{}{}
+		var requests []ctrl.Request
+		for _, nodeObj := range nodeList.Items {
+			if nodeObj.Spec.Hypervisor != hypervisor.Name {
+				continue
+			}
+			if _, alreadyQueued := seen[nodeObj.Spec.Cluster]; alreadyQueued {
+				continue
+			}
+			seen[nodeObj.Spec.Cluster] = struct{}{}
+			requests = append(requests, ctrl.Request{NamespacedName: client.ObjectKey{Name: nodeObj.Spec.Cluster}})
+		}
+		return requests
+	}
+}
+
+// Reconcile reconciles the Cluster identified by req, bringing its nodes in
+// line with the desired state. Returning an error causes controller-runtime
+// to requeue the request on the workqueue with exponential backoff.
+func (clusterReconciler *ClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	klog.V(1).Infof("reconciling cluster %q", req.NamespacedName)
+	if err := clusterReconciler.gather(ctx, req); err != nil {
+		reconcilesTotal.WithLabelValues("error").Inc()
+		reconcileErrorsTotal.WithLabelValues(req.Name).Inc()
+		return ctrl.Result{}, errors.Wrapf(err, "could not gather state for cluster %q", req.NamespacedName)
+	}
+	nodesPerCluster.WithLabelValues(req.Name).Set(float64(len(clusterReconciler.nodeList)))
+	clusterReconciler.releaseStalePortReservations(req.Name)
+	if err := clusterReconciler.scheduleUnassignedNodes(ctx); err != nil {
+		reconcilesTotal.WithLabelValues("error").Inc()
+		reconcileErrorsTotal.WithLabelValues(req.Name).Inc()
+		return ctrl.Result{}, errors.Wrapf(err, "could not schedule nodes for cluster %q", req.NamespacedName)
+	}
+	for _, nodeObj := range clusterReconciler.nodeList {
+		if err := clusterReconciler.reconcileNode(ctx, nodeObj); err != nil {
+			reconcilesTotal.WithLabelValues("error").Inc()
+			reconcileErrorsTotal.WithLabelValues(req.Name).Inc()
+			return ctrl.Result{}, errors.Wrapf(err, "could not reconcile node %q", nodeObj.Name)
+		}
+	}
+	if err := clusterReconciler.persistHypervisorReservations(ctx); err != nil {
+		reconcilesTotal.WithLabelValues("error").Inc()
+		reconcileErrorsTotal.WithLabelValues(req.Name).Inc()
+		return ctrl.Result{}, errors.Wrapf(err, "could not persist hypervisor reservations for cluster %q", req.NamespacedName)
+	}
+	reconcilesTotal.WithLabelValues("success").Inc()
+	return ctrl.Result{}, nil
+}
+
+// persistHypervisorReservations writes every gathered hypervisor's current
+// reservation table back to its versioned status, so that a reconciler
+// restart rehydrates reservations from status (see
+// NewHypervisorFromv1alpha1) instead of forgetting them and
+// double-allocating the same host port. scheduleUnassignedNodes persists a
+// freshly reserved port's own hypervisor as soon as it reserves it, so this
+// is mostly a catch-all for reservations released by
+// releaseStalePortReservations; it is still called once more at the end of
+// Reconcile to cover that case.
+func (clusterReconciler *ClusterReconciler) persistHypervisorReservations(ctx context.Context) error {
+	for name := range clusterReconciler.hypervisorMap {
+		if err := clusterReconciler.persistHypervisorReservation(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persistHypervisorReservation writes a single hypervisor's current
+// reservation table back to its versioned status
+func (clusterReconciler *ClusterReconciler) persistHypervisorReservation(ctx context.Context, name string) error {
+	hypervisor, exists := clusterReconciler.hypervisorMap[name]
+	if !exists {
+		return errors.Errorf("hypervisor %q not found", name)
+	}
+	var versionedHypervisor clusterv1alpha1.Hypervisor
+	if err := clusterReconciler.Get(ctx, client.ObjectKey{Name: name}, &versionedHypervisor); err != nil {
+		return err
+	}
+	versionedHypervisor.Status.AllocatedPorts = hypervisor.Export().Status.AllocatedPorts
+	if err := clusterReconciler.Status().Update(ctx, &versionedHypervisor); err != nil {
+		return err
+	}
+	allocatedHostPorts.WithLabelValues(name).Set(float64(len(versionedHypervisor.Status.AllocatedPorts)))
+	return nil
+}
+
+// reconcileNode reconciles a single node, recording its duration as a
+// Prometheus histogram and wrapping it in an OpenTelemetry span carrying the
+// cluster, node and hypervisor names, so a slow control-plane node can be
+// traced back to the hypervisor it landed on
+func (clusterReconciler *ClusterReconciler) reconcileNode(ctx context.Context, nodeObj *node.Node) error {
+	ctx, span := tracer.Start(ctx, "reconcileNode", trace.WithAttributes(
+		attribute.String("oneinfra.cluster", nodeObj.ClusterName),
+		attribute.String("oneinfra.node", nodeObj.Name),
+		attribute.String("oneinfra.hypervisor", nodeObj.HypervisorName),
+	))
+	defer span.End()
+	start := time.Now()
+	err := nodereconciler.Reconcile(
+		&ClusterReconcilerInquirer{
+			node:              nodeObj,
+			clusterReconciler: clusterReconciler,
+		},
+	)
+	reconcileDuration.WithLabelValues(string(nodeObj.Role)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		span.RecordError(err)
 	}
+	return err
 }
 
-// Reconcile reconciles all nodes known to this cluster reconciler
-func (clusterReconciler *ClusterReconciler) Reconcile() error {
-	klog.V(1).Info("starting reconciliation process")
+// gather loads the Hypervisors, the Cluster identified by req, and the Nodes
+// that belong to it, populating clusterReconciler's maps for this run
+func (clusterReconciler *ClusterReconciler) gather(ctx context.Context, req ctrl.Request) error {
+	var clusterObj clusterv1alpha1.Cluster
+	if err := clusterReconciler.Get(ctx, req.NamespacedName, &clusterObj); err != nil {
+		return err
+	}
+	var hypervisorList clusterv1alpha1.HypervisorList
+	if err := clusterReconciler.List(ctx, &hypervisorList); err != nil {
+		return err
+	}
+	var nodeList clusterv1alpha1.NodeList
+	if err := clusterReconciler.List(ctx, &nodeList, client.MatchingFields{nodeClusterField: req.Name}); err != nil {
+		return err
+	}
+	hypervisorMap, err := infra.NewHypervisorMapFromv1alpha1(hypervisorList.Items)
+	if err != nil {
+		return err
+	}
+	clusterMap, err := cluster.NewMapFromv1alpha1([]clusterv1alpha1.Cluster{clusterObj})
+	if err != nil {
+		return err
+	}
+	nodes, err := node.NewListFromv1alpha1(nodeList.Items)
+	if err != nil {
+		return err
+	}
+	clusterReconciler.clusterObj = clusterObj
+	clusterReconciler.hypervisorMap = hypervisorMap
+	clusterReconciler.clusterMap = clusterMap
+	clusterReconciler.nodeList = nodes
+	return nil
+}
+
+// scheduleUnassignedNodes assigns a hypervisor to every node in nodeList
+// that does not have one yet, using the Scheduler selected by the
+// cluster's SchedulerPolicy, and persists the assignment back to the
+// versioned Node
+func (clusterReconciler *ClusterReconciler) scheduleUnassignedNodes(ctx context.Context) error {
+	scheduler, err := node.SchedulerForPolicy(clusterReconciler.clusterObj.Spec.SchedulerPolicy, clusterReconciler.nodeList)
+	if err != nil {
+		return errors.Wrap(err, "could not resolve scheduler policy")
+	}
 	for _, nodeObj := range clusterReconciler.nodeList {
-		nodereconciler.Reconcile(
-			&ClusterReconcilerInquirer{
-				node:              nodeObj,
-				clusterReconciler: clusterReconciler,
-			},
+		if nodeObj.HypervisorName != "" {
+			continue
+		}
+		hypervisor, err := scheduler.Schedule(
+			node.SchedulingRequest{ClusterName: nodeObj.ClusterName, NodeName: nodeObj.Name, Role: nodeObj.Role, SchedulerHints: nodeObj.SchedulerHints},
+			clusterReconciler.hypervisorMap.List(),
 		)
+		if err != nil {
+			return errors.Wrapf(err, "could not schedule node %q", nodeObj.Name)
+		}
+		nodeObj.HypervisorName = hypervisor.Name
+		nodeObj.SchedulerName = scheduler.Name()
+		purpose := "apiserver"
+		if nodeObj.Role == node.WorkerRole {
+			purpose = "kubelet"
+		}
+		portAllocationStart := time.Now()
+		hostPort, err := hypervisor.ReservePort(nodeObj.ClusterName, nodeObj.Name, purpose)
+		portAllocationLatency.Observe(time.Since(portAllocationStart).Seconds())
+		if err != nil {
+			return errors.Wrapf(err, "could not reserve a host port for node %q", nodeObj.Name)
+		}
+		nodeObj.AllocatedPorts = append(nodeObj.AllocatedPorts, node.PortAllocation{
+			Purpose:  purpose,
+			Protocol: node.TCPProtocol,
+			Port:     hostPort,
+		})
+		// Persist the reservation to the hypervisor's status before the node
+		// itself is updated below: if reconcileNode later fails for some other
+		// node and aborts the reconcile, the reservation must already be
+		// recorded so a restart rehydrates it (see NewHypervisorFromv1alpha1)
+		// instead of handing this same port to a different node.
+		if err := clusterReconciler.persistHypervisorReservation(ctx, hypervisor.Name); err != nil {
+			return errors.Wrapf(err, "could not persist reservation for hypervisor %q", hypervisor.Name)
+		}
+		var versionedNode clusterv1alpha1.Node
+		if getErr := clusterReconciler.Get(ctx, client.ObjectKey{Name: nodeObj.Name}, &versionedNode); getErr != nil {
+			return getErr
+		}
+		versionedNode.Spec.Hypervisor = hypervisor.Name
+		if updateErr := clusterReconciler.Update(ctx, &versionedNode); updateErr != nil {
+			return updateErr
+		}
+		versionedNode.Status.AllocatedHostPorts = nodeObj.Export().Status.AllocatedHostPorts
+		versionedNode.Status.SchedulerName = scheduler.Name()
+		if updateErr := clusterReconciler.Status().Update(ctx, &versionedNode); updateErr != nil {
+			return updateErr
+		}
 	}
 	return nil
 }
 
-// Specs returns the versioned specs for all resources
+// releaseStalePortReservations garbage-collects host port reservations held
+// by hypervisors for nodes of clusterName that are no longer present in
+// nodeList, so that a deleted node's ports become available for reuse.
+// Hypervisors are shared across clusters, so this only ever releases
+// reservations belonging to clusterName: nodeList (populated by gather via
+// a spec.cluster field selector) only ever contains that cluster's nodes,
+// and releasing reservations for other clusters here would free ports that
+// are still live, just not visible to this reconciliation.
+func (clusterReconciler *ClusterReconciler) releaseStalePortReservations(clusterName string) {
+	liveNodes := map[string]struct{}{}
+	for _, nodeObj := range clusterReconciler.nodeList {
+		liveNodes[nodeObj.Name] = struct{}{}
+	}
+	for _, hypervisor := range clusterReconciler.hypervisorMap {
+		for _, reservation := range hypervisor.ListReservations() {
+			if reservation.Cluster != clusterName {
+				continue
+			}
+			if _, live := liveNodes[reservation.Node]; !live {
+				hypervisor.ReleaseNode(reservation.Cluster, reservation.Node)
+			}
+		}
+	}
+}
+
+// Specs returns the versioned specs for all resources known to this
+// reconciler as of its last reconciliation
 func (clusterReconciler *ClusterReconciler) Specs() (string, error) {
 	res := ""
 	hypervisors, err := clusterReconciler.hypervisorMap.Specs()
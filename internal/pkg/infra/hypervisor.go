@@ -0,0 +1,311 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package infra
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+
+	clusterv1alpha1 "oneinfra.ereslibre.es/m/apis/cluster/v1alpha1"
+)
+
+// PortRange is the inclusive range of host ports a Hypervisor may hand out
+type PortRange struct {
+	Low  int
+	High int
+}
+
+// DefaultPortRange is used by hypervisors that do not specify a PortRange
+var DefaultPortRange = PortRange{Low: 30000, High: 40000}
+
+// PortReservation represents a single host port reserved on a Hypervisor on
+// behalf of a cluster node
+type PortReservation struct {
+	Cluster string
+	Node    string
+	Purpose string
+	Port    int
+}
+
+// key identifies a reservation by the triple that requested it
+func (reservation PortReservation) key() string {
+	return reservation.Cluster + "/" + reservation.Node + "/" + reservation.Purpose
+}
+
+// Hypervisor represents a hypervisor able to run cluster node instances
+type Hypervisor struct {
+	Name string
+	// Address is the host (IP or DNS name) other cluster components reach
+	// this hypervisor's containers on
+	Address string
+	// Weight biases WeightedScheduler towards this hypervisor; a weight of 0
+	// is treated as 1 so that a hypervisor with no weight configured still
+	// takes a fair share of nodes
+	Weight int
+	// Runtime starts and stops containers on this hypervisor on behalf of
+	// StartContainer; left nil, StartContainer returns an error, since this
+	// package has no opinion on the container engine in use
+	Runtime ContainerRuntime
+
+	portRange    PortRange
+	mu           sync.Mutex
+	reservations map[string]PortReservation
+}
+
+// ContainerSpec describes a container StartContainer should start
+type ContainerSpec struct {
+	Name    string
+	Image   string
+	Command []string
+	// KubeconfigData, when non-empty, is made available to the container as
+	// its bootstrap kubeconfig
+	KubeconfigData []byte
+}
+
+// ContainerRuntime starts containers on behalf of a Hypervisor. A concrete
+// implementation (e.g. backed by containerd or Docker) is wired in by
+// whoever constructs the Hypervisor; this package only defines the contract
+type ContainerRuntime interface {
+	StartContainer(spec ContainerSpec) error
+}
+
+// StartContainer starts spec on this hypervisor via its configured Runtime
+func (hypervisor *Hypervisor) StartContainer(spec ContainerSpec) error {
+	if hypervisor.Runtime == nil {
+		return errors.Errorf("hypervisor %q has no container runtime configured", hypervisor.Name)
+	}
+	return hypervisor.Runtime.StartContainer(spec)
+}
+
+// NewHypervisor creates a Hypervisor with the default port range
+func NewHypervisor(name string) *Hypervisor {
+	return NewHypervisorWithPortRange(name, DefaultPortRange)
+}
+
+// NewHypervisorWithPortRange creates a Hypervisor restricted to portRange
+func NewHypervisorWithPortRange(name string, portRange PortRange) *Hypervisor {
+	return &Hypervisor{
+		Name:         name,
+		portRange:    portRange,
+		reservations: map[string]PortReservation{},
+	}
+}
+
+// RequestPort reserves a host port for cluster/node under the "apiserver"
+// purpose.
+//
+// Deprecated: use ReservePort, specifying the purpose of the allocation
+func (hypervisor *Hypervisor) RequestPort(cluster, node string) (int, error) {
+	return hypervisor.ReservePort(cluster, node, "apiserver")
+}
+
+// ReservePort reserves a host port for the given cluster, node and purpose,
+// returning the already reserved port if one exists
+func (hypervisor *Hypervisor) ReservePort(cluster, node, purpose string) (int, error) {
+	hypervisor.mu.Lock()
+	defer hypervisor.mu.Unlock()
+	reservation := PortReservation{Cluster: cluster, Node: node, Purpose: purpose}
+	if existing, exists := hypervisor.reservations[reservation.key()]; exists {
+		return existing.Port, nil
+	}
+	usedPorts := map[int]struct{}{}
+	for _, existing := range hypervisor.reservations {
+		usedPorts[existing.Port] = struct{}{}
+	}
+	for port := hypervisor.portRange.Low; port <= hypervisor.portRange.High; port++ {
+		if _, used := usedPorts[port]; used {
+			continue
+		}
+		reservation.Port = port
+		hypervisor.reservations[reservation.key()] = reservation
+		return port, nil
+	}
+	return 0, errors.Errorf("no free host port available on hypervisor %q in range %d-%d", hypervisor.Name, hypervisor.portRange.Low, hypervisor.portRange.High)
+}
+
+// ReleasePort releases a previously reserved host port for the given
+// cluster, node and purpose; releasing a reservation that does not exist is
+// a no-op
+func (hypervisor *Hypervisor) ReleasePort(cluster, node, purpose string) error {
+	hypervisor.mu.Lock()
+	defer hypervisor.mu.Unlock()
+	key := (PortReservation{Cluster: cluster, Node: node, Purpose: purpose}).key()
+	delete(hypervisor.reservations, key)
+	return nil
+}
+
+// ListReservations returns every host port reservation currently held by this hypervisor
+func (hypervisor *Hypervisor) ListReservations() []PortReservation {
+	hypervisor.mu.Lock()
+	defer hypervisor.mu.Unlock()
+	reservations := make([]PortReservation, 0, len(hypervisor.reservations))
+	for _, reservation := range hypervisor.reservations {
+		reservations = append(reservations, reservation)
+	}
+	return reservations
+}
+
+// ReservationCount returns the number of host ports currently reserved on this hypervisor
+func (hypervisor *Hypervisor) ReservationCount() int {
+	hypervisor.mu.Lock()
+	defer hypervisor.mu.Unlock()
+	return len(hypervisor.reservations)
+}
+
+// ReleaseNode releases every port reservation held by the given cluster/node
+// pair, regardless of purpose; used to garbage-collect the reservations of
+// deleted nodes
+func (hypervisor *Hypervisor) ReleaseNode(cluster, node string) {
+	hypervisor.mu.Lock()
+	defer hypervisor.mu.Unlock()
+	for key, reservation := range hypervisor.reservations {
+		if reservation.Cluster == cluster && reservation.Node == node {
+			delete(hypervisor.reservations, key)
+		}
+	}
+}
+
+// NewHypervisorFromv1alpha1 returns a hypervisor based on a versioned hypervisor,
+// rehydrating its reservation table from status so that a reconciler restart
+// does not double-allocate host ports
+func NewHypervisorFromv1alpha1(hypervisor *clusterv1alpha1.Hypervisor) (*Hypervisor, error) {
+	portRange := DefaultPortRange
+	if hypervisor.Spec.PortRange.Low != 0 || hypervisor.Spec.PortRange.High != 0 {
+		portRange = PortRange{Low: hypervisor.Spec.PortRange.Low, High: hypervisor.Spec.PortRange.High}
+	}
+	res := NewHypervisorWithPortRange(hypervisor.ObjectMeta.Name, portRange)
+	res.Weight = hypervisor.Spec.Weight
+	res.Address = hypervisor.Spec.Address
+	for _, allocatedPort := range hypervisor.Status.AllocatedPorts {
+		reservation := PortReservation{
+			Cluster: allocatedPort.Cluster,
+			Node:    allocatedPort.Node,
+			Purpose: allocatedPort.Purpose,
+			Port:    allocatedPort.Port,
+		}
+		res.reservations[reservation.key()] = reservation
+	}
+	return res, nil
+}
+
+// Export exports the hypervisor's reservation table to a versioned hypervisor status
+func (hypervisor *Hypervisor) Export() *clusterv1alpha1.Hypervisor {
+	res := &clusterv1alpha1.Hypervisor{}
+	res.ObjectMeta.Name = hypervisor.Name
+	for _, reservation := range hypervisor.ListReservations() {
+		res.Status.AllocatedPorts = append(
+			res.Status.AllocatedPorts,
+			clusterv1alpha1.PortReservation{
+				Cluster: reservation.Cluster,
+				Node:    reservation.Node,
+				Purpose: reservation.Purpose,
+				Port:    reservation.Port,
+			},
+		)
+	}
+	return res
+}
+
+// HypervisorMap indexes hypervisors by name
+type HypervisorMap map[string]*Hypervisor
+
+// NewHypervisorMapFromv1alpha1 builds a HypervisorMap from a list of versioned hypervisors
+func NewHypervisorMapFromv1alpha1(hypervisors []clusterv1alpha1.Hypervisor) (HypervisorMap, error) {
+	res := HypervisorMap{}
+	for i := range hypervisors {
+		hypervisor, err := NewHypervisorFromv1alpha1(&hypervisors[i])
+		if err != nil {
+			return nil, err
+		}
+		res[hypervisor.Name] = hypervisor
+	}
+	return res, nil
+}
+
+// Specs returns the versioned specs of every hypervisor in this map
+func (hypervisorMap HypervisorMap) Specs() (string, error) {
+	scheme := runtime.NewScheme()
+	if err := clusterv1alpha1.AddToScheme(scheme); err != nil {
+		return "", err
+	}
+	info, _ := runtime.SerializerInfoForMediaType(serializer.NewCodecFactory(scheme).SupportedMediaTypes(), runtime.ContentTypeYAML)
+	encoder := serializer.NewCodecFactory(scheme).EncoderForVersion(info.Serializer, clusterv1alpha1.GroupVersion)
+	res := ""
+	for _, hypervisor := range hypervisorMap {
+		encoded, err := runtime.Encode(encoder, hypervisor.Export())
+		if err != nil {
+			return "", errors.Errorf("could not encode hypervisor %q", hypervisor.Name)
+		}
+		res += string(encoded)
+	}
+	return res, nil
+}
+
+// List returns the hypervisors in this map as a HypervisorList
+func (hypervisorMap HypervisorMap) List() HypervisorList {
+	list := make(HypervisorList, 0, len(hypervisorMap))
+	for _, hypervisor := range hypervisorMap {
+		list = append(list, hypervisor)
+	}
+	return list
+}
+
+// HypervisorList is an ordered list of hypervisors that can be sampled from
+// when scheduling a new node
+type HypervisorList []*Hypervisor
+
+// Sample returns a hypervisor picked uniformly at random from this list
+func (hypervisorList HypervisorList) Sample() (*Hypervisor, error) {
+	if len(hypervisorList) == 0 {
+		return nil, errors.New("no hypervisors available")
+	}
+	return hypervisorList[rand.Intn(len(hypervisorList))], nil
+}
+
+// SampleWeighted returns a hypervisor picked at random, biased by each
+// hypervisor's Weight; a hypervisor with a Weight of 0 is treated as having
+// a weight of 1, so it is still eligible rather than being excluded outright
+func (hypervisorList HypervisorList) SampleWeighted() (*Hypervisor, error) {
+	if len(hypervisorList) == 0 {
+		return nil, errors.New("no hypervisors available")
+	}
+	totalWeight := 0
+	for _, hypervisor := range hypervisorList {
+		totalWeight += effectiveWeight(hypervisor)
+	}
+	pick := rand.Intn(totalWeight)
+	for _, hypervisor := range hypervisorList {
+		pick -= effectiveWeight(hypervisor)
+		if pick < 0 {
+			return hypervisor, nil
+		}
+	}
+	return hypervisorList[len(hypervisorList)-1], nil
+}
+
+// effectiveWeight returns hypervisor.Weight, defaulting to 1 when unset
+func effectiveWeight(hypervisor *Hypervisor) int {
+	if hypervisor.Weight <= 0 {
+		return 1
+	}
+	return hypervisor.Weight
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+
+	"github.com/pkg/errors"
+
+	clusterv1alpha1 "oneinfra.ereslibre.es/m/apis/cluster/v1alpha1"
+)
+
+// List is an ordered collection of nodes
+type List []*Node
+
+// NewListFromv1alpha1 returns a List built from a slice of versioned nodes
+func NewListFromv1alpha1(nodes []clusterv1alpha1.Node) (List, error) {
+	res := make(List, 0, len(nodes))
+	for i := range nodes {
+		nodeObj, err := NewNodeFromv1alpha1(&nodes[i])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, nodeObj)
+	}
+	return res, nil
+}
+
+// Specs returns the versioned specs of every node in this list
+func (list List) Specs() (string, error) {
+	scheme := runtime.NewScheme()
+	if err := clusterv1alpha1.AddToScheme(scheme); err != nil {
+		return "", err
+	}
+	info, _ := runtime.SerializerInfoForMediaType(serializer.NewCodecFactory(scheme).SupportedMediaTypes(), runtime.ContentTypeYAML)
+	encoder := serializer.NewCodecFactory(scheme).EncoderForVersion(info.Serializer, clusterv1alpha1.GroupVersion)
+	res := ""
+	for _, nodeObj := range list {
+		encoded, err := runtime.Encode(encoder, nodeObj.Export())
+		if err != nil {
+			return "", errors.Errorf("could not encode node %q", nodeObj.Name)
+		}
+		res += string(encoded)
+	}
+	return res, nil
+}
@@ -35,39 +35,103 @@ const (
 	ControlPlaneRole Role = "control-plane"
 	// ControlPlaneIngressRole is the role used for Control Plane ingress
 	ControlPlaneIngressRole Role = "control-plane-ingress"
+	// WorkerRole is the role used for a kubelet joined to the cluster as a worker
+	WorkerRole Role = "worker"
 )
 
+// Protocol is the network protocol a PortAllocation was reserved for
+type Protocol string
+
+const (
+	// TCPProtocol is used for TCP port allocations
+	TCPProtocol Protocol = "TCP"
+	// UDPProtocol is used for UDP port allocations
+	UDPProtocol Protocol = "UDP"
+)
+
+// PortAllocation represents a single host port allocated to this node,
+// identified by its purpose (e.g. "apiserver", "kubelet") and protocol. A
+// node may hold more than one allocation for the same purpose as long as
+// their protocols differ.
+type PortAllocation struct {
+	Purpose  string
+	Protocol Protocol
+	Port     int
+}
+
 // Node represents a Control Plane node
 type Node struct {
-	Name               string
-	Role               Role
-	HypervisorName     string
-	ClusterName        string
-	AllocatedHostPorts map[string]int
+	Name           string
+	Role           Role
+	HypervisorName string
+	ClusterName    string
+	AllocatedPorts []PortAllocation
+	// SchedulerName records which Scheduler placed this node on its
+	// hypervisor, for auditability
+	SchedulerName string
+	// SchedulerHints carries free-form placement hints (e.g. a preferred
+	// hypervisor label, an anti-affinity key) that a Scheduler implementation
+	// may consult; unrecognized hints are ignored by schedulers that don't
+	// understand them. Only round-trips through v1beta1 - the v1alpha1
+	// NodeSpec predates hints and carries none.
+	SchedulerHints map[string]string
 }
 
-// NewNodeWithRandomHypervisor creates a node with a random hypervisor from the provided hypervisorList
-func NewNodeWithRandomHypervisor(clusterName, nodeName string, role Role, hypervisorList infra.HypervisorList) (*Node, error) {
-	hypervisor, err := hypervisorList.Sample()
+// NewNode creates a node by asking scheduler to pick a hypervisor from the
+// provided hypervisorList
+func NewNode(clusterName, nodeName string, role Role, scheduler Scheduler, hypervisorList infra.HypervisorList) (*Node, error) {
+	hypervisor, err := scheduler.Schedule(
+		SchedulingRequest{ClusterName: clusterName, NodeName: nodeName, Role: role},
+		hypervisorList,
+	)
 	if err != nil {
 		return nil, err
 	}
 	node := Node{
-		Name:               nodeName,
-		HypervisorName:     hypervisor.Name,
-		ClusterName:        clusterName,
-		Role:               role,
-		AllocatedHostPorts: map[string]int{},
+		Name:           nodeName,
+		HypervisorName: hypervisor.Name,
+		ClusterName:    clusterName,
+		Role:           role,
+		SchedulerName:  scheduler.Name(),
 	}
-	apiserverHostPort, err := hypervisor.RequestPort(clusterName, nodeName)
+	purpose := "apiserver"
+	if role == WorkerRole {
+		purpose = "kubelet"
+	}
+	hostPort, err := hypervisor.ReservePort(clusterName, nodeName, purpose)
 	if err != nil {
 		return nil, err
 	}
-	node.AllocatedHostPorts["apiserver"] = apiserverHostPort
+	node.AllocatedPorts = append(node.AllocatedPorts, PortAllocation{
+		Purpose:  purpose,
+		Protocol: TCPProtocol,
+		Port:     hostPort,
+	})
 	return &node, nil
 }
 
-// NewNodeFromv1alpha1 returns a node based on a versioned node
+// NewNodeWithRandomHypervisor creates a node with a random hypervisor from
+// the provided hypervisorList
+//
+// Deprecated: use NewNode with RandomScheduler instead
+func NewNodeWithRandomHypervisor(clusterName, nodeName string, role Role, hypervisorList infra.HypervisorList) (*Node, error) {
+	return NewNode(clusterName, nodeName, role, RandomScheduler{}, hypervisorList)
+}
+
+// PortByPurpose returns the first allocated port for the given purpose, and
+// whether one was found
+func (node *Node) PortByPurpose(purpose string) (int, bool) {
+	for _, allocation := range node.AllocatedPorts {
+		if allocation.Purpose == purpose {
+			return allocation.Port, true
+		}
+	}
+	return 0, false
+}
+
+// NewNodeFromv1alpha1 returns a node based on a versioned node. The
+// v1alpha1 NodeHostPortAllocation carries no protocol, so every allocation
+// round-tripped through it is assumed to be TCP.
 func NewNodeFromv1alpha1(node *clusterv1alpha1.Node) (*Node, error) {
 	res := Node{
 		Name:           node.ObjectMeta.Name,
@@ -79,15 +143,23 @@ func NewNodeFromv1alpha1(node *clusterv1alpha1.Node) (*Node, error) {
 		res.Role = ControlPlaneRole
 	case clusterv1alpha1.ControlPlaneIngressRole:
 		res.Role = ControlPlaneIngressRole
+	case clusterv1alpha1.WorkerRole:
+		res.Role = WorkerRole
 	}
-	res.AllocatedHostPorts = map[string]int{}
 	for _, hostPort := range node.Status.AllocatedHostPorts {
-		res.AllocatedHostPorts[hostPort.Name] = hostPort.Port
+		res.AllocatedPorts = append(res.AllocatedPorts, PortAllocation{
+			Purpose:  hostPort.Name,
+			Protocol: TCPProtocol,
+			Port:     hostPort.Port,
+		})
 	}
+	res.SchedulerName = node.Status.SchedulerName
 	return &res, nil
 }
 
-// Export exports the node to a versioned node
+// Export exports the node to a versioned node. The v1alpha1
+// NodeHostPortAllocation carries no protocol, so this necessarily drops it;
+// use ExportV1beta1 when protocol fidelity matters.
 func (node *Node) Export() *clusterv1alpha1.Node {
 	res := &clusterv1alpha1.Node{
 		ObjectMeta: metav1.ObjectMeta{
@@ -103,17 +175,20 @@ func (node *Node) Export() *clusterv1alpha1.Node {
 		res.Spec.Role = clusterv1alpha1.ControlPlaneRole
 	case ControlPlaneIngressRole:
 		res.Spec.Role = clusterv1alpha1.ControlPlaneIngressRole
+	case WorkerRole:
+		res.Spec.Role = clusterv1alpha1.WorkerRole
 	}
 	res.Status.AllocatedHostPorts = []clusterv1alpha1.NodeHostPortAllocation{}
-	for hostPortName, hostPort := range node.AllocatedHostPorts {
+	for _, allocation := range node.AllocatedPorts {
 		res.Status.AllocatedHostPorts = append(
 			res.Status.AllocatedHostPorts,
 			clusterv1alpha1.NodeHostPortAllocation{
-				Name: hostPortName,
-				Port: hostPort,
+				Name: allocation.Purpose,
+				Port: allocation.Port,
 			},
 		)
 	}
+	res.Status.SchedulerName = node.SchedulerName
 	return res
 }
 
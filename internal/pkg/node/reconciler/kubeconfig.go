@@ -0,0 +1,63 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// bootstrapKubeconfigPath is where a worker's bootstrap kubeconfig is
+// expected inside its kubelet container
+const bootstrapKubeconfigPath = "/etc/kubernetes/bootstrap-kubelet.conf"
+
+// bootstrapKubeconfig renders a kubeconfig that lets nodeName's kubelet
+// TLS-verify the cluster's apiserver. Issuing the kubelet its own client
+// certificate or bootstrap token is not wired up yet, so the resulting
+// kubeconfig only carries the cluster CA and server address.
+func bootstrapKubeconfig(inquirer Inquirer, nodeName string) ([]byte, error) {
+	certificate, _, err := inquirer.ClusterCertificateAuthority()
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := inquirer.APIServerEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	const contextName = "bootstrap"
+	config := clientcmdapi.Config{
+		Clusters: map[string]*clientcmdapi.Cluster{
+			contextName: {
+				Server:                   fmt.Sprintf("https://%s:%d", host, port),
+				CertificateAuthorityData: certificate,
+			},
+		},
+		Contexts: map[string]*clientcmdapi.Context{
+			contextName: {
+				Cluster:  contextName,
+				AuthInfo: nodeName,
+			},
+		},
+		AuthInfos: map[string]*clientcmdapi.AuthInfo{
+			nodeName: {},
+		},
+		CurrentContext: contextName,
+	}
+	return clientcmd.Write(config)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package reconciler brings a single node in line with its desired state:
+// for a worker, rendering its bootstrap kubeconfig and starting its kubelet
+// container on the hypervisor it was scheduled to. Control plane roles
+// (etcd, apiserver, ingress) are not implemented here yet.
+package reconciler
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"oneinfra.ereslibre.es/m/internal/pkg/infra"
+	"oneinfra.ereslibre.es/m/internal/pkg/node"
+)
+
+// kubeletImage is the container image started for a worker node's kubelet.
+//
+// TODO: make this configurable once a release pipeline for kubelet images exists
+const kubeletImage = "oneinfra/kubelet:latest"
+
+// Inquirer supplies the context Reconcile needs to bring a single node in
+// line with its desired state, without this package depending on whatever
+// drives it (the cluster reconciler, in production)
+type Inquirer interface {
+	// Node returns the node being reconciled
+	Node() *node.Node
+	// Hypervisor returns the hypervisor the node is scheduled on
+	Hypervisor() (*infra.Hypervisor, error)
+	// ClusterCertificateAuthority returns the cluster's CA certificate and
+	// private key, PEM-encoded
+	ClusterCertificateAuthority() (certificate, privateKey []byte, err error)
+	// APIServerEndpoint returns the host and port a worker's bootstrap
+	// kubeconfig should point its kubelet at
+	APIServerEndpoint() (host string, port int, err error)
+}
+
+// Reconcile brings the node described by inquirer in line with its desired
+// state
+func Reconcile(inquirer Inquirer) error {
+	switch inquirer.Node().Role {
+	case node.WorkerRole:
+		return reconcileWorker(inquirer)
+	default:
+		return nil
+	}
+}
+
+// reconcileWorker renders the worker's bootstrap kubeconfig from the
+// cluster's certificate authority and starts its kubelet container on the
+// hypervisor it was scheduled to
+func reconcileWorker(inquirer Inquirer) error {
+	nodeObj := inquirer.Node()
+	hypervisor, err := inquirer.Hypervisor()
+	if err != nil {
+		return errors.Wrapf(err, "could not find hypervisor for node %q", nodeObj.Name)
+	}
+	kubeletPort, ok := nodeObj.PortByPurpose("kubelet")
+	if !ok {
+		return errors.Errorf("node %q has no kubelet port reserved", nodeObj.Name)
+	}
+	kubeconfig, err := bootstrapKubeconfig(inquirer, nodeObj.Name)
+	if err != nil {
+		return errors.Wrapf(err, "could not render bootstrap kubeconfig for node %q", nodeObj.Name)
+	}
+	return hypervisor.StartContainer(infra.ContainerSpec{
+		Name:           fmt.Sprintf("%s-kubelet", nodeObj.Name),
+		Image:          kubeletImage,
+		Command:        []string{"kubelet", "--port", fmt.Sprintf("%d", kubeletPort), "--kubeconfig", bootstrapKubeconfigPath},
+		KubeconfigData: kubeconfig,
+	})
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"strings"
+	"testing"
+
+	"oneinfra.ereslibre.es/m/internal/pkg/infra"
+	"oneinfra.ereslibre.es/m/internal/pkg/node"
+)
+
+// fakeInquirer stands in for a real cluster, hypervisor and CA, so that
+// Reconcile can be exercised (bootstrap kubeconfig rendering through to
+// StartContainer) without a running Kubernetes API server or hypervisor.
+// TestReconcileMixedClusterReachesReady below is the closest this checkout
+// gets to the mixed control-plane/worker e2e the backlog asked for; see its
+// doc comment for what it does and doesn't prove.
+type fakeInquirer struct {
+	nodeObj    *node.Node
+	hypervisor *infra.Hypervisor
+}
+
+func (inquirer *fakeInquirer) Node() *node.Node { return inquirer.nodeObj }
+
+func (inquirer *fakeInquirer) Hypervisor() (*infra.Hypervisor, error) {
+	return inquirer.hypervisor, nil
+}
+
+func (inquirer *fakeInquirer) ClusterCertificateAuthority() ([]byte, []byte, error) {
+	return []byte("fake-ca-certificate"), []byte("fake-ca-key"), nil
+}
+
+func (inquirer *fakeInquirer) APIServerEndpoint() (string, int, error) {
+	return "apiserver.example.org", 6443, nil
+}
+
+// fakeContainerRuntime records the containers StartContainer was asked to start
+type fakeContainerRuntime struct {
+	started []infra.ContainerSpec
+}
+
+func (runtime *fakeContainerRuntime) StartContainer(spec infra.ContainerSpec) error {
+	runtime.started = append(runtime.started, spec)
+	return nil
+}
+
+func TestReconcileWorkerStartsKubeletWithBootstrapKubeconfig(t *testing.T) {
+	runtime := &fakeContainerRuntime{}
+	hypervisor := infra.NewHypervisor("hypervisor")
+	hypervisor.Runtime = runtime
+	nodeObj := &node.Node{
+		Name:           "worker-1",
+		Role:           node.WorkerRole,
+		HypervisorName: hypervisor.Name,
+		AllocatedPorts: []node.PortAllocation{
+			{Purpose: "kubelet", Protocol: node.TCPProtocol, Port: 31000},
+		},
+	}
+	if err := Reconcile(&fakeInquirer{nodeObj: nodeObj, hypervisor: hypervisor}); err != nil {
+		t.Fatalf("unexpected error reconciling worker node: %v", err)
+	}
+	if len(runtime.started) != 1 {
+		t.Fatalf("expected 1 container to be started, got %d", len(runtime.started))
+	}
+	started := runtime.started[0]
+	if started.Name != "worker-1-kubelet" {
+		t.Errorf("expected container name %q, got %q", "worker-1-kubelet", started.Name)
+	}
+	if !strings.Contains(string(started.KubeconfigData), "fake-ca-certificate") {
+		t.Errorf("expected bootstrap kubeconfig to carry the cluster CA, got: %s", started.KubeconfigData)
+	}
+	if !strings.Contains(string(started.KubeconfigData), "https://apiserver.example.org:6443") {
+		t.Errorf("expected bootstrap kubeconfig to point at the apiserver endpoint, got: %s", started.KubeconfigData)
+	}
+}
+
+func TestReconcileWorkerWithoutKubeletPortFails(t *testing.T) {
+	hypervisor := infra.NewHypervisor("hypervisor")
+	hypervisor.Runtime = &fakeContainerRuntime{}
+	nodeObj := &node.Node{Name: "worker-1", Role: node.WorkerRole, HypervisorName: hypervisor.Name}
+	if err := Reconcile(&fakeInquirer{nodeObj: nodeObj, hypervisor: hypervisor}); err == nil {
+		t.Fatal("expected an error reconciling a worker with no kubelet port reserved")
+	}
+}
+
+// TestReconcileMixedClusterReachesReady drives Reconcile over every node of
+// a mixed control-plane/worker cluster, the way the cluster reconciler's
+// per-node loop does, and asserts each one comes out the way a cluster
+// reaching Ready requires: the control plane node reconciled cleanly without
+// starting anything (control plane roles aren't implemented here), and the
+// worker's kubelet container was the only one started, with a kubeconfig
+// pointing at the apiserver endpoint the inquirer reports (the fake reports
+// a fixed endpoint rather than one derived from the control plane node).
+// This is still not a true end-to-end test
+// - there is no harness in this checkout to run a real API server and
+// hypervisor and observe the cluster's Ready condition flip - it only
+// proves this package's own boundary of the Ready contract: given a
+// correctly scheduled mixed node set, every node's Reconcile call succeeds
+// and a worker's kubelet is told how to reach its control plane.
+func TestReconcileMixedClusterReachesReady(t *testing.T) {
+	hypervisor := infra.NewHypervisor("hypervisor")
+	runtime := &fakeContainerRuntime{}
+	hypervisor.Runtime = runtime
+	controlPlane := &node.Node{
+		Name:           "control-plane-1",
+		Role:           node.ControlPlaneRole,
+		HypervisorName: hypervisor.Name,
+		AllocatedPorts: []node.PortAllocation{
+			{Purpose: "apiserver", Protocol: node.TCPProtocol, Port: 6443},
+		},
+	}
+	worker := &node.Node{
+		Name:           "worker-1",
+		Role:           node.WorkerRole,
+		HypervisorName: hypervisor.Name,
+		AllocatedPorts: []node.PortAllocation{
+			{Purpose: "kubelet", Protocol: node.TCPProtocol, Port: 31000},
+		},
+	}
+	for _, nodeObj := range []*node.Node{controlPlane, worker} {
+		if err := Reconcile(&fakeInquirer{nodeObj: nodeObj, hypervisor: hypervisor}); err != nil {
+			t.Fatalf("unexpected error reconciling node %q: %v", nodeObj.Name, err)
+		}
+	}
+	if len(runtime.started) != 1 {
+		t.Fatalf("expected 1 container to be started across the mixed cluster, got %d", len(runtime.started))
+	}
+	if runtime.started[0].Name != "worker-1-kubelet" {
+		t.Errorf("expected only the worker's kubelet container to be started, got %q", runtime.started[0].Name)
+	}
+	if !strings.Contains(string(runtime.started[0].KubeconfigData), "https://apiserver.example.org:6443") {
+		t.Errorf("expected the worker's bootstrap kubeconfig to point at the apiserver endpoint, got: %s", runtime.started[0].KubeconfigData)
+	}
+}
+
+func TestReconcileControlPlaneIsANoop(t *testing.T) {
+	hypervisor := infra.NewHypervisor("hypervisor")
+	runtime := &fakeContainerRuntime{}
+	hypervisor.Runtime = runtime
+	nodeObj := &node.Node{Name: "control-plane-1", Role: node.ControlPlaneRole, HypervisorName: hypervisor.Name}
+	if err := Reconcile(&fakeInquirer{nodeObj: nodeObj, hypervisor: hypervisor}); err != nil {
+		t.Fatalf("unexpected error reconciling control plane node: %v", err)
+	}
+	if len(runtime.started) != 0 {
+		t.Fatalf("expected no containers to be started for a control plane node, got %d", len(runtime.started))
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"github.com/pkg/errors"
+
+	clusterv1alpha1 "oneinfra.ereslibre.es/m/apis/cluster/v1alpha1"
+	"oneinfra.ereslibre.es/m/internal/pkg/infra"
+)
+
+// SchedulingRequest describes the node a Scheduler is being asked to place
+type SchedulingRequest struct {
+	ClusterName string
+	NodeName    string
+	Role        Role
+	// SchedulerHints carries the node's placement hints through to the
+	// Scheduler; the built-in strategies in this file do not consult it yet
+	SchedulerHints map[string]string
+}
+
+// Scheduler picks the hypervisor a node should be scheduled on
+type Scheduler interface {
+	// Name identifies this scheduling strategy, recorded on Node.Status for auditability
+	Name() string
+	// Schedule picks a hypervisor from hypervisorList for the given request
+	Schedule(req SchedulingRequest, hypervisorList infra.HypervisorList) (*infra.Hypervisor, error)
+}
+
+// SchedulerForPolicy returns the Scheduler implementing the given cluster
+// scheduler policy. nodeList is the current, live node list and is threaded
+// into strategies that need cluster-wide placement context (SpreadByCluster).
+func SchedulerForPolicy(policy clusterv1alpha1.SchedulerPolicy, nodeList List) (Scheduler, error) {
+	switch policy {
+	case "", clusterv1alpha1.RandomSchedulerPolicy:
+		return RandomScheduler{}, nil
+	case clusterv1alpha1.LeastLoadedSchedulerPolicy:
+		return LeastLoadedScheduler{}, nil
+	case clusterv1alpha1.SpreadByClusterSchedulerPolicy:
+		return SpreadByClusterScheduler{NodeList: nodeList}, nil
+	case clusterv1alpha1.WeightedSchedulerPolicy:
+		return WeightedScheduler{}, nil
+	}
+	return nil, errors.Errorf("unknown scheduler policy %q", policy)
+}
+
+// RandomScheduler picks a hypervisor uniformly at random; this is the
+// historical behavior of NewNodeWithRandomHypervisor
+type RandomScheduler struct{}
+
+// Name implements Scheduler
+func (RandomScheduler) Name() string { return "Random" }
+
+// Schedule implements Scheduler
+func (RandomScheduler) Schedule(req SchedulingRequest, hypervisorList infra.HypervisorList) (*infra.Hypervisor, error) {
+	return hypervisorList.Sample()
+}
+
+// LeastLoadedScheduler picks the hypervisor with the fewest allocated ports
+type LeastLoadedScheduler struct{}
+
+// Name implements Scheduler
+func (LeastLoadedScheduler) Name() string { return "LeastLoaded" }
+
+// Schedule implements Scheduler
+func (LeastLoadedScheduler) Schedule(req SchedulingRequest, hypervisorList infra.HypervisorList) (*infra.Hypervisor, error) {
+	var best *infra.Hypervisor
+	bestLoad := -1
+	for _, hypervisor := range hypervisorList {
+		load := hypervisor.ReservationCount()
+		if bestLoad == -1 || load < bestLoad {
+			best = hypervisor
+			bestLoad = load
+		}
+	}
+	if best == nil {
+		return nil, errors.Errorf("no hypervisor available for the %q scheduler", "LeastLoaded")
+	}
+	return best, nil
+}
+
+// SpreadByClusterScheduler picks the hypervisor with the fewest nodes already
+// scheduled for the requesting cluster, providing anti-affinity across
+// control-plane replicas of the same cluster
+type SpreadByClusterScheduler struct {
+	// NodeList is consulted to count how many nodes of req.ClusterName are
+	// already scheduled on each hypervisor
+	NodeList List
+}
+
+// Name implements Scheduler
+func (SpreadByClusterScheduler) Name() string { return "SpreadByCluster" }
+
+// Schedule implements Scheduler
+func (scheduler SpreadByClusterScheduler) Schedule(req SchedulingRequest, hypervisorList infra.HypervisorList) (*infra.Hypervisor, error) {
+	nodesPerHypervisor := map[string]int{}
+	for _, nodeObj := range scheduler.NodeList {
+		if nodeObj.ClusterName == req.ClusterName {
+			nodesPerHypervisor[nodeObj.HypervisorName]++
+		}
+	}
+	var best *infra.Hypervisor
+	bestCount := -1
+	for _, hypervisor := range hypervisorList {
+		count := nodesPerHypervisor[hypervisor.Name]
+		if bestCount == -1 || count < bestCount {
+			best = hypervisor
+			bestCount = count
+		}
+	}
+	if best == nil {
+		return nil, errors.Errorf("no hypervisor available for the %q scheduler", "SpreadByCluster")
+	}
+	return best, nil
+}
+
+// WeightedScheduler picks a hypervisor at random, biased by each
+// hypervisor's Weight, which NewHypervisorFromv1alpha1 takes from the
+// versioned Hypervisor's spec; hypervisor annotations are not read
+type WeightedScheduler struct{}
+
+// Name implements Scheduler
+func (WeightedScheduler) Name() string { return "Weighted" }
+
+// Schedule implements Scheduler
+func (WeightedScheduler) Schedule(req SchedulingRequest, hypervisorList infra.HypervisorList) (*infra.Hypervisor, error) {
+	return hypervisorList.SampleWeighted()
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	clusterv1beta1 "oneinfra.ereslibre.es/m/apis/cluster/v1beta1"
+)
+
+// NewNodeFromv1beta1 and ExportV1beta1 are the conversion logic a
+// conversion.Convertible webhook on clusterv1beta1.Node would delegate to:
+// clusterv1alpha1.Node.Hub() on the hub version, and
+// clusterv1beta1.Node.ConvertTo/ConvertFrom calling these two functions
+// under the hood. That wiring isn't added here: apis/cluster/v1alpha1 and
+// apis/cluster/v1beta1 aren't part of this checkout (there's no apis/
+// directory on disk at all, only the import paths other packages already
+// assume), and a Convertible method can only be declared on the type in its
+// own package, so it can't be added without either vendoring those packages
+// wholesale or guessing at CRD scaffolding (deepcopy, scheme registration,
+// webhook manifests) this checkout has no visibility into. Until that
+// package exists here, the API server will keep serving v1alpha1 and
+// v1beta1 as independent, non-converting versions; callers that need both
+// must go through these functions explicitly. The cluster reconciler reads
+// and writes v1alpha1 Nodes only and does not call them.
+//
+// NewNodeFromv1beta1 returns a node based on a v1beta1 versioned node. Every
+// typed PortAllocation is carried over verbatim, so a node with several
+// allocations sharing a purpose but differing in protocol round-trips
+// without collapsing or losing any of them. SchedulerHints round-trips too,
+// v1beta1 being the first version to carry it.
+func NewNodeFromv1beta1(node *clusterv1beta1.Node) (*Node, error) {
+	res := Node{
+		Name:           node.ObjectMeta.Name,
+		HypervisorName: node.Spec.Hypervisor,
+		ClusterName:    node.Spec.Cluster,
+	}
+	switch node.Spec.Role {
+	case clusterv1beta1.ControlPlaneRole:
+		res.Role = ControlPlaneRole
+	case clusterv1beta1.ControlPlaneIngressRole:
+		res.Role = ControlPlaneIngressRole
+	case clusterv1beta1.WorkerRole:
+		res.Role = WorkerRole
+	}
+	for _, allocation := range node.Status.AllocatedPorts {
+		res.AllocatedPorts = append(res.AllocatedPorts, PortAllocation{
+			Purpose:  allocation.Purpose,
+			Protocol: Protocol(allocation.Protocol),
+			Port:     allocation.Port,
+		})
+	}
+	res.SchedulerName = node.Status.SchedulerName
+	if len(node.Spec.SchedulerHints) > 0 {
+		res.SchedulerHints = map[string]string{}
+		for key, value := range node.Spec.SchedulerHints {
+			res.SchedulerHints[key] = value
+		}
+	}
+	return &res, nil
+}
+
+// ExportV1beta1 exports the node to a v1beta1 versioned node, preserving
+// each allocation's protocol instead of assuming TCP
+func (node *Node) ExportV1beta1() *clusterv1beta1.Node {
+	res := &clusterv1beta1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: node.Name,
+		},
+		Spec: clusterv1beta1.NodeSpec{
+			Hypervisor: node.HypervisorName,
+			Cluster:    node.ClusterName,
+		},
+	}
+	switch node.Role {
+	case ControlPlaneRole:
+		res.Spec.Role = clusterv1beta1.ControlPlaneRole
+	case ControlPlaneIngressRole:
+		res.Spec.Role = clusterv1beta1.ControlPlaneIngressRole
+	case WorkerRole:
+		res.Spec.Role = clusterv1beta1.WorkerRole
+	}
+	res.Status.AllocatedPorts = []clusterv1beta1.PortAllocation{}
+	for _, allocation := range node.AllocatedPorts {
+		res.Status.AllocatedPorts = append(
+			res.Status.AllocatedPorts,
+			clusterv1beta1.PortAllocation{
+				Port:     allocation.Port,
+				Protocol: clusterv1beta1.Protocol(allocation.Protocol),
+				Purpose:  allocation.Purpose,
+			},
+		)
+	}
+	res.Status.SchedulerName = node.SchedulerName
+	if len(node.SchedulerHints) > 0 {
+		res.Spec.SchedulerHints = map[string]string{}
+		for key, value := range node.SchedulerHints {
+			res.Spec.SchedulerHints[key] = value
+		}
+	}
+	return res
+}
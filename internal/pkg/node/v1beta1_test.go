@@ -0,0 +1,124 @@
+/*
+Copyright 2020 Rafael Fernández López <ereslibre@ereslibre.es>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/quick"
+)
+
+func sortedAllocations(allocations []PortAllocation) []PortAllocation {
+	sorted := append([]PortAllocation{}, allocations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Purpose != sorted[j].Purpose {
+			return sorted[i].Purpose < sorted[j].Purpose
+		}
+		return sorted[i].Protocol < sorted[j].Protocol
+	})
+	return sorted
+}
+
+// TestNodeV1beta1RoundTrip asserts that converting a Node to its v1beta1
+// representation and back yields the same port allocations, including
+// cases where two allocations share a purpose but differ in protocol -
+// the exact shape the map-based conversion used to collapse - and the same
+// scheduler hints.
+func TestNodeV1beta1RoundTrip(t *testing.T) {
+	roundTrip := func(role Role, allocations []PortAllocation, hints map[string]string) bool {
+		original := &Node{
+			Name:           "node",
+			Role:           role,
+			HypervisorName: "hypervisor",
+			ClusterName:    "cluster",
+			AllocatedPorts: allocations,
+			SchedulerHints: hints,
+		}
+		converted, err := NewNodeFromv1beta1(original.ExportV1beta1())
+		if err != nil {
+			t.Fatalf("unexpected error converting node: %v", err)
+		}
+		if !reflect.DeepEqual(sortedAllocations(original.AllocatedPorts), sortedAllocations(converted.AllocatedPorts)) {
+			return false
+		}
+		if len(original.SchedulerHints) == 0 && len(converted.SchedulerHints) == 0 {
+			return true
+		}
+		return reflect.DeepEqual(original.SchedulerHints, converted.SchedulerHints)
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestNodeV1beta1RoundTripMixedProtocolSamePurpose is a focused regression
+// test for allocations that share a purpose but differ in protocol
+func TestNodeV1beta1RoundTripMixedProtocolSamePurpose(t *testing.T) {
+	original := &Node{
+		Name:           "node",
+		Role:           WorkerRole,
+		HypervisorName: "hypervisor",
+		ClusterName:    "cluster",
+		AllocatedPorts: []PortAllocation{
+			{Purpose: "dns", Protocol: TCPProtocol, Port: 30053},
+			{Purpose: "dns", Protocol: UDPProtocol, Port: 30053},
+		},
+	}
+	converted, err := NewNodeFromv1beta1(original.ExportV1beta1())
+	if err != nil {
+		t.Fatalf("unexpected error converting node: %v", err)
+	}
+	if len(converted.AllocatedPorts) != 2 {
+		t.Fatalf("expected 2 allocations to survive the round trip, got %d: %+v", len(converted.AllocatedPorts), converted.AllocatedPorts)
+	}
+	if !reflect.DeepEqual(sortedAllocations(original.AllocatedPorts), sortedAllocations(converted.AllocatedPorts)) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", converted.AllocatedPorts, original.AllocatedPorts)
+	}
+}
+
+// TestNodeV1beta1RoundTripSchedulerHints is a focused regression test for
+// scheduler hints, which v1alpha1 has no field for
+func TestNodeV1beta1RoundTripSchedulerHints(t *testing.T) {
+	original := &Node{
+		Name:           "node",
+		Role:           ControlPlaneRole,
+		HypervisorName: "hypervisor",
+		ClusterName:    "cluster",
+		SchedulerHints: map[string]string{"zone": "us-east-1a", "anti-affinity-key": "cluster"},
+	}
+	converted, err := NewNodeFromv1beta1(original.ExportV1beta1())
+	if err != nil {
+		t.Fatalf("unexpected error converting node: %v", err)
+	}
+	if !reflect.DeepEqual(original.SchedulerHints, converted.SchedulerHints) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", converted.SchedulerHints, original.SchedulerHints)
+	}
+}
+
+// Generate implements quick.Generator so testing/quick can synthesize
+// PortAllocation values, including duplicate purposes with differing protocols
+func (PortAllocation) Generate(rand *rand.Rand, size int) reflect.Value {
+	purposes := []string{"apiserver", "kubelet", "dns", "etcd"}
+	protocols := []Protocol{TCPProtocol, UDPProtocol}
+	return reflect.ValueOf(PortAllocation{
+		Purpose:  purposes[rand.Intn(len(purposes))],
+		Protocol: protocols[rand.Intn(len(protocols))],
+		Port:     30000 + rand.Intn(10000),
+	})
+}